@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -17,9 +24,40 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// uploadPartSize is the chunk size the s3Storage driver uses for each S3
+// UploadPart call. S3 requires every part but the last to be at least 5MB.
+const uploadPartSize = 8 << 20
+
+// hashingReader wraps an io.Reader, tallying size and a running SHA-256 as
+// the bytes flow through to the storage backend.
+type hashingReader struct {
+	r      io.Reader
+	hasher hash.Hash
+	size   int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, hasher: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if n > 0 {
+		h.hasher.Write(p[:n])
+		h.size += int64(n)
+	}
+	return n, err
+}
+
+func (h *hashingReader) Checksum() string {
+	return hex.EncodeToString(h.hasher.Sum(nil))
+}
+
 type ImageMetadata struct {
 	ID          int       `json:"id"`
 	Filename    string    `json:"filename"`
@@ -40,32 +78,75 @@ func (rec *StatusRecorder) WriteHeader(code int) {
 }
 
 type App struct {
-	db       *sql.DB
-	s3Client *s3.Client
-	bucket   string
+	db              *sql.DB
+	storage         Storage
+	presignTTL      time.Duration
+	processingQueue chan processingJob
 }
 
 // 1. Middleware is just a function that takes a Handler and returns a Handler
+//
+// LoggerMiddleware logs each request as structured JSON via slog and records
+// it against the Prometheus HTTP metrics, labeled by a route template rather
+// than the raw path so per-image/per-variant URLs don't blow up label
+// cardinality.
 func LoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		start := time.Now()
+		requestID := uuid.NewString()
 
 		recorder := &StatusRecorder{ResponseWriter: w, StatusCode: http.StatusOK}
 		next.ServeHTTP(recorder, r)
 
 		elapsed := time.Since(start)
-		color := "\033[32m" // Green
-		if recorder.StatusCode >= 400 && recorder.StatusCode < 500 {
-			color = "\033[31m" // Red
-		}
-
-		fmt.Printf("%s %d Method [%s] path %s  duration %v\n", color, recorder.StatusCode, r.Method, r.URL.Path, elapsed)
-
+		status := strconv.Itoa(recorder.StatusCode)
+		route := routeLabel(r.URL.Path)
+
+		httpRequestsTotal.WithLabelValues(route, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method, status).Observe(elapsed.Seconds())
+
+		slog.Info("request",
+			"request_id", requestID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.StatusCode,
+			"duration_ms", elapsed.Milliseconds(),
+			"bytes", r.ContentLength,
+		)
 	})
 }
 
+// routeLabel collapses a request path down to a low-cardinality route
+// template suitable for a Prometheus label, so e.g. /download/42 and
+// /download/43 both roll up under "/download/{id}".
+func routeLabel(path string) string {
+	switch {
+	case path == "/health":
+		return "/health"
+	case path == "/metrics":
+		return "/metrics"
+	case path == "/images" || path == "/images/":
+		return "/images"
+	case path == "/images/presign-upload":
+		return "/images/presign-upload"
+	case path == "/images/finalize":
+		return "/images/finalize"
+	case strings.HasSuffix(path, "/presign-download"):
+		return "/images/{id}/presign-download"
+	case strings.Contains(path, "/variant/"):
+		return "/images/{id}/variant/{name}"
+	case strings.HasPrefix(path, "/images/"):
+		return "/images/{id}"
+	case strings.HasPrefix(path, "/download/"):
+		return "/download/{id}"
+	default:
+		return "other"
+	}
+}
+
 func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 
 	// 1. Get Config from Docker Environment
 	connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
@@ -95,7 +176,7 @@ func main() {
 	// 3. Create the Table (Migration)
 	_, err = db.Exec(`Create table if not exists images (
 		id serial PRIMARY KEY,
-		filename text not null, 
+		filename text not null,
 		size BIGINT,
 		object_key text not null,
 		content_type text,
@@ -104,43 +185,99 @@ func main() {
 	if err != nil {
 		log.Fatal("Could not create table:", err)
 	}
-
-	// 1. Load the Default Config (Just Credentials & Region)
-	// We do NOT set the endpoint here anymore.
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion("us-east-1"), // MinIO needs a region, even if fake
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			os.Getenv("S3_ACCESS_KEY"),
-			os.Getenv("S3_SECRET_KEY"),
-			"", // Session Token (empty)
-		)),
-	)
+	// objects tracks each distinct (content-addressed) blob in storage and
+	// how many images rows still reference it, so createImage can dedup
+	// re-uploads and deleteImage only removes bytes once the last reference is gone.
+	_, err = db.Exec(`Create table if not exists objects (
+		object_key text PRIMARY KEY,
+		size BIGINT NOT NULL,
+		content_type text,
+		ref_count INT NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		log.Fatal("Could not create table:", err)
+	}
+	// derivatives holds the lazily-generated thumbnails/variants for each image.
+	_, err = db.Exec(`Create table if not exists derivatives (
+		id serial PRIMARY KEY,
+		image_id INT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		name text not null,
+		object_key text not null,
+		content_type text,
+		created_at TIMESTAMP NOT NULL,
+		UNIQUE(image_id, name)
+	)`)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Could not create table:", err)
 	}
 
-	// 2. Create the S3 Client with MinIO Specific Options
-	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		// --- THE MODERN WAY ---
-		// Use BaseEndpoint instead of a custom resolver
-		s3Endpoint := "http://" + os.Getenv("S3_ENDPOINT")
-		o.BaseEndpoint = aws.String(s3Endpoint)
+	// 4. Pick the storage backend. STORAGE_URL selects the driver:
+	//   unset            -> native AWS SDK v2 S3 driver (MinIO-compatible, the original behavior)
+	//   file:///some/dir -> local filesystem driver, handy for dev/testing without MinIO
+	//   s3://, gs://, azblob:// -> gocloud.dev/blob, for GCS/Azure or an S3-compatible store
+	storageURL := os.Getenv("STORAGE_URL")
+	bucketName := os.Getenv("S3_BUCKET")
+	var storage Storage
+
+	switch {
+	case storageURL == "":
+		// 1. Load the Default Config (Just Credentials & Region)
+		// We do NOT set the endpoint here anymore.
+		cfg, err := config.LoadDefaultConfig(context.TODO(),
+			config.WithRegion("us-east-1"), // MinIO needs a region, even if fake
+			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+				os.Getenv("S3_ACCESS_KEY"),
+				os.Getenv("S3_SECRET_KEY"),
+				"", // Session Token (empty)
+			)),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		// Required for MinIO (Forces http://host/bucket/file instead of http://bucket.host/file)
-		o.UsePathStyle = true
-	})
+		// 2. Create the S3 Client with MinIO Specific Options
+		s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+			// --- THE MODERN WAY ---
+			// Use BaseEndpoint instead of a custom resolver
+			s3Endpoint := "http://" + os.Getenv("S3_ENDPOINT")
+			o.BaseEndpoint = aws.String(s3Endpoint)
+
+			// Required for MinIO (Forces http://host/bucket/file instead of http://bucket.host/file)
+			o.UsePathStyle = true
+		}, withS3Metrics)
+
+		// 3. Create Bucket (Quick check)
+		_, _ = s3Client.CreateBucket(context.TODO(), &s3.CreateBucketInput{
+			Bucket: aws.String(bucketName),
+		})
+
+		storage = newS3Storage(s3Client, s3.NewPresignClient(s3Client), bucketName)
+	case strings.HasPrefix(storageURL, "file://"):
+		storage, err = newFSStorage(strings.TrimPrefix(storageURL, "file://"))
+		if err != nil {
+			log.Fatal("Could not open filesystem storage:", err)
+		}
+	default:
+		storage, err = openGoCloudStorage(context.TODO(), storageURL)
+		if err != nil {
+			log.Fatal("Could not open storage backend:", err)
+		}
+	}
 
-	// 3. Create Bucket (Quick check)
-	bucketName := os.Getenv("S3_BUCKET")
-	_, _ = s3Client.CreateBucket(context.TODO(), &s3.CreateBucketInput{
-		Bucket: aws.String(bucketName),
-	})
+	// 5. Presign TTL (how long presigned upload/download URLs stay valid)
+	presignTTL := 15 * time.Minute
+	if raw := os.Getenv("PRESIGN_TTL_SECONDS"); raw != "" {
+		if secs, err := strconv.Atoi(raw); err == nil && secs > 0 {
+			presignTTL = time.Duration(secs) * time.Second
+		}
+	}
 
 	app := &App{
-		db:       db,
-		s3Client: s3Client,
-		bucket:   bucketName,
+		db:         db,
+		storage:    storage,
+		presignTTL: presignTTL,
 	}
+	app.startProcessingWorkers()
 
 	// 1. The Router (ServeMux)
 	// In Go std lib, we use a "Mux" (Multiplexer) to match URLs to functions.
@@ -149,9 +286,12 @@ func main() {
 	// 2. Register Routes
 	// We map the URL path to a handler function
 	mux.HandleFunc("/health", healthHandler)
+	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/images/", app.imagesHandler)
 	mux.HandleFunc("/images", app.imagesHandler)
 	mux.HandleFunc("/download/", app.downloadImage)
+	mux.HandleFunc("/images/presign-upload", app.presignUploadHandler)
+	mux.HandleFunc("/images/finalize", app.finalizeUploadHandler)
 
 	fmt.Println("Server starting on :8080...")
 
@@ -180,6 +320,18 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 // Since std lib (pre-Go 1.22) routes are simple, we often handle GET/POST inside one function.
 func (app *App) imagesHandler(w http.ResponseWriter, r *http.Request) {
 
+	// "/images/{id}/presign-download" and "/images/{id}/variant/{name}" both
+	// have variable segments, so ServeMux can't route them as literal
+	// patterns like the other presign endpoints.
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/presign-download") {
+		app.presignDownloadHandler(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/variant/") {
+		app.variantHandler(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		app.listImages(w, r)
@@ -196,7 +348,12 @@ func (app *App) imagesHandler(w http.ResponseWriter, r *http.Request) {
 func (app *App) listImages(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	rows, err := app.db.Query("select id, filename, size, object_key, content_type, created_at from images order by id")
+	var rows *sql.Rows
+	err := observeDBQuery("list_images", func() error {
+		var qErr error
+		rows, qErr = app.db.Query("select id, filename, size, object_key, content_type, created_at from images order by id")
+		return qErr
+	})
 	if err != nil {
 		http.Error(w, "Failed to query database", http.StatusInternalServerError)
 		return
@@ -222,58 +379,141 @@ func (app *App) listImages(w http.ResponseWriter, r *http.Request) {
 
 // Logic for POST
 func (app *App) createImage(w http.ResponseWriter, r *http.Request) {
-	// 1. Parse Multipart Form (Max 10MB)
-	r.ParseMultipartForm(10 << 20)
+	ctx := context.Background()
 
-	// 2. Retrieve file
-	file, handler, err := r.FormFile("image")
+	// 1. Stream the multipart body instead of buffering it - this lets us
+	// accept uploads far larger than would fit in memory/disk via ParseMultipartForm.
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+		http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	fmt.Printf("Uploading File: %+v\n", handler.Filename)
+	var part *multipart.Part
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Error retrieving file", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error retrieving file", http.StatusBadRequest)
+			return
+		}
+		if p.FormName() == "image" {
+			part = p
+			break
+		}
+		p.Close()
+	}
+	defer part.Close()
 
-	fmt.Printf("Body: File: %v\n", file)
-	// 3. Upload to S3 (MinIO) - V2 Syntax
-	_, err = app.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(app.bucket),
-		Key:         aws.String(handler.Filename),
-		Body:        file,
-		ContentType: aws.String(handler.Header.Get("Content-Type")),
-	})
+	filename := part.FileName()
+	contentType := part.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
 
+	fmt.Printf("Uploading File: %+v\n", filename)
+
+	// 2. We don't know the content hash until we've seen every byte, so the
+	// upload first lands under a throwaway staging key, then gets promoted
+	// to its content-addressed home once we know the digest.
+	stagingKey := "staging/" + uuid.NewString()
+	tracked := newInFlightReader(part)
+	hashed := newHashingReader(tracked)
+	if err := app.storage.Put(ctx, stagingKey, hashed, contentType); err != nil {
+		tracked.release()
+		http.Error(w, "Failed to upload to storage", http.StatusInternalServerError)
+		fmt.Println("Storage Put Error:", err)
+		return
+	}
+	totalSize := hashed.size
+	objectKey := contentAddressedKey(hashed.Checksum())
+
+	fmt.Printf("Completed upload %s: sha256=%s size=%d\n", filename, hashed.Checksum(), totalSize)
+
+	// 3. Promote the staged upload to its canonical key, then atomically
+	// insert-or-increment the object's ref count. The Copy runs unconditionally
+	// (copying staging -> the same destination key is idempotent), and the
+	// upsert below replaces a select-then-branch that left a window where two
+	// concurrent uploads of identical new content both missed the row, both
+	// copied, and the loser 500ed on the objects PK instead of converging.
+	tx, err := app.db.BeginTx(ctx, nil)
 	if err != nil {
-		http.Error(w, "Failed to upload to S3", http.StatusInternalServerError)
-		fmt.Println("S3 Upload Error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	// 4. Save Metadata to DB (Same as before)
-	var id int
-	var createdAt time.Time = time.Now()
-	err = app.db.QueryRow(`INSERT INTO images (filename, size, object_key, content_type, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
-		handler.Filename, handler.Size, handler.Filename, handler.Header.Get("Content-Type"), createdAt).Scan(&id)
+	if err := app.storage.Copy(ctx, stagingKey, objectKey); err != nil {
+		http.Error(w, "Failed to finalize storage object", http.StatusInternalServerError)
+		fmt.Println("Storage Copy Error:", err)
+		return
+	}
+	var refCount int
+	err = observeDBQuery("upsert_object_refcount", func() error {
+		return tx.QueryRow(
+			`INSERT INTO objects (object_key, size, content_type, ref_count)
+			 VALUES ($1, $2, $3, 1)
+			 ON CONFLICT (object_key) DO UPDATE SET ref_count = objects.ref_count + 1
+			 RETURNING ref_count`,
+			objectKey, totalSize, contentType).Scan(&refCount)
+	})
+	if err != nil {
+		http.Error(w, "Database upsert failed", http.StatusInternalServerError)
+		return
+	}
+	if refCount > 1 {
+		fmt.Printf("Deduped upload %s: object %s already stored\n", filename, objectKey)
+	}
 
+	// The staging object is either now duplicated under objectKey, or
+	// redundant because objectKey already existed - either way it can go.
+	if err := app.storage.Delete(ctx, stagingKey); err != nil {
+		fmt.Println("Storage Delete (staging) Error:", err)
+	}
+
+	// 4. Save Metadata to DB - only now that the object is actually in storage.
+	var id int
+	createdAt := time.Now()
+	err = observeDBQuery("insert_image", func() error {
+		return tx.QueryRow(`INSERT INTO images (filename, size, object_key, content_type, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+			filename, totalSize, objectKey, contentType, createdAt).Scan(&id)
+	})
 	if err != nil {
 		http.Error(w, "Database insert failed", http.StatusInternalServerError)
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Thumbnails/variants are generated off the request path, in the
+	// background worker pool, so the response isn't held up by resizing.
+	app.enqueueProcessing(id, objectKey, contentType)
+
 	// 5. Respond
 	response := ImageMetadata{
 		ID:          id,
-		Filename:    handler.Filename,
-		Size:        handler.Size,
-		ObjectKey:   handler.Filename,
-		ContentType: handler.Header.Get("Content-Type"),
+		Filename:    filename,
+		Size:        totalSize,
+		ObjectKey:   objectKey,
+		ContentType: contentType,
 		CreatedAt:   createdAt,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// contentAddressedKey builds a restic-style sharded object key from a
+// SHA-256 hex digest, e.g. "sha256/ab/cd/abcd...".
+func contentAddressedKey(digest string) string {
+	return fmt.Sprintf("sha256/%s/%s/%s", digest[:2], digest[2:4], digest)
+}
+
 // Logic for delete
 
 func (app *App) deleteImage(w http.ResponseWriter, r *http.Request) {
@@ -287,28 +527,94 @@ func (app *App) deleteImage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid Image ID", http.StatusBadRequest)
 		return
 	}
+	ctx := context.TODO()
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// 1. Get Object Key from DB
 	var objectKey string
-	err = app.db.QueryRow("SELECT object_key FROM images WHERE id=$1", imageID).Scan(&objectKey)
+	err = observeDBQuery("select_image_object_key", func() error {
+		return tx.QueryRow("SELECT object_key FROM images WHERE id=$1", imageID).Scan(&objectKey)
+	})
 	if err != nil {
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
-	// 2. Delete from S3
-	_, err = app.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(app.bucket),
-		Key:    aws.String(objectKey),
+
+	// Derivative object keys are derived from the shared sourceObjectKey, not
+	// the image_id, so they're only safe to remove from storage once the
+	// source itself is going away below. Read them before the cascade delete
+	// below wipes the derivatives rows.
+	var derivativeKeys []string
+	err = observeDBQuery("select_derivative_keys", func() error {
+		rows, qErr := tx.Query("SELECT object_key FROM derivatives WHERE image_id=$1", imageID)
+		if qErr != nil {
+			return qErr
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			if qErr := rows.Scan(&key); qErr != nil {
+				return qErr
+			}
+			derivativeKeys = append(derivativeKeys, key)
+		}
+		return rows.Err()
 	})
 	if err != nil {
-		http.Error(w, "Failed to delete from S3", http.StatusInternalServerError)
+		http.Error(w, "Failed to list derivatives", http.StatusInternalServerError)
 		return
 	}
-	// 3. Delete from DB
-	_, err = app.db.Exec("DELETE FROM images WHERE id=$1", imageID)
+
+	// 2. Drop the images row and this image's reference to the object.
+	err = observeDBQuery("delete_image", func() error {
+		_, qErr := tx.Exec("DELETE FROM images WHERE id=$1", imageID)
+		return qErr
+	})
 	if err != nil {
 		http.Error(w, "Failed to delete from database", http.StatusInternalServerError)
 		return
 	}
+	var refCount int
+	err = observeDBQuery("decrement_object_refcount", func() error {
+		return tx.QueryRow("UPDATE objects SET ref_count = ref_count - 1 WHERE object_key=$1 RETURNING ref_count", objectKey).Scan(&refCount)
+	})
+	if err != nil {
+		http.Error(w, "Failed to update object reference count", http.StatusInternalServerError)
+		return
+	}
+
+	// 3. Only the last reference actually removes bytes from storage - and
+	// that's the only time its derivatives (thumbnails, EXIF-stripped variant)
+	// are orphaned too, since they live under keys derived from objectKey.
+	if refCount <= 0 {
+		err = observeDBQuery("delete_object", func() error {
+			_, qErr := tx.Exec("DELETE FROM objects WHERE object_key=$1", objectKey)
+			return qErr
+		})
+		if err != nil {
+			http.Error(w, "Failed to delete object record", http.StatusInternalServerError)
+			return
+		}
+		if err := app.storage.Delete(ctx, objectKey); err != nil {
+			http.Error(w, "Failed to delete from storage", http.StatusInternalServerError)
+			return
+		}
+		for _, key := range derivativeKeys {
+			if err := app.storage.Delete(ctx, key); err != nil {
+				fmt.Println("Storage Delete (derivative) Error:", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 
 }
@@ -324,26 +630,282 @@ func (app *App) downloadImage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid Image ID", http.StatusBadRequest)
 		return
 	}
-	var objectKey string
-	err = app.db.QueryRow("SELECT object_key FROM images WHERE id=$1", imageID).Scan(&objectKey)
+	var objectKey, filename string
+	err = observeDBQuery("select_image_object_key", func() error {
+		return app.db.QueryRow("SELECT object_key, filename FROM images WHERE id=$1", imageID).Scan(&objectKey, &filename)
+	})
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	opts := GetRangeOptions{Range: r.Header.Get("Range")}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		opts.IfNoneMatch = inm
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil {
+			opts.IfModifiedSince = t
+		}
+	}
+
+	result, err := app.storage.GetRange(context.TODO(), objectKey, opts)
+	if err != nil {
+		var rangeErr *errRangeNotSatisfiable
+		if errors.As(err, &rangeErr) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", rangeErr.size))
+			http.Error(w, "Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		http.Error(w, "Failed to download from storage", http.StatusInternalServerError)
+		return
+	}
+
+	if result.ETag != "" {
+		w.Header().Set("ETag", result.ETag)
+	}
+	if !result.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", result.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if result.NotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	defer result.Body.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Content-Length", strconv.FormatInt(result.ContentLength, 10))
+	if result.ContentRange != "" {
+		w.Header().Set("Content-Range", result.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	io.Copy(w, result.Body)
+}
+
+// HANDLER: GET /images/{id}/variant/{name} - streams a derivative
+// (e.g. "thumb_512"), generating it on the spot if it hasn't been made yet.
+func (app *App) variantHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/images/")
+	idPart, name, found := strings.Cut(rest, "/variant/")
+	if !found || idPart == "" || name == "" {
+		http.Error(w, "Image ID and variant name are required", http.StatusBadRequest)
+		return
+	}
+	imageID, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.Error(w, "Invalid Image ID", http.StatusBadRequest)
+		return
+	}
+
+	var sourceObjectKey string
+	err = observeDBQuery("select_image_object_key", func() error {
+		return app.db.QueryRow("SELECT object_key FROM images WHERE id=$1", imageID).Scan(&sourceObjectKey)
+	})
 	if err != nil {
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
-	resp, err := app.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(app.bucket),
-		Key:    aws.String(objectKey),
+
+	ctx := r.Context()
+	derivativeKey, contentType, err := app.getOrGenerateDerivative(ctx, imageID, sourceObjectKey, name)
+	if err != nil {
+		http.Error(w, "Failed to generate variant", http.StatusInternalServerError)
+		fmt.Println("Variant Error:", err)
+		return
+	}
+
+	body, _, err := app.storage.Get(ctx, derivativeKey)
+	if err != nil {
+		http.Error(w, "Failed to download variant", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", contentType)
+	io.Copy(w, body)
+}
+
+type PresignUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+}
+
+type PresignUploadResponse struct {
+	UploadURL   string `json:"upload_url"`
+	ObjectKey   string `json:"object_key"`
+	ContentType string `json:"content_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// HANDLER: Issue a presigned PUT URL so the client can upload straight to S3
+// without the request body ever passing through this server.
+func (app *App) presignUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PresignUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ContentType == "" {
+		http.Error(w, "content_type is required", http.StatusBadRequest)
+		return
+	}
+
+	// Never trust the client's filename as the key - generate our own.
+	objectKey := uuid.NewString()
+	if ext := filepath.Ext(req.Filename); ext != "" {
+		objectKey += ext
+	}
+
+	uploadURL, err := app.storage.PresignPut(context.TODO(), objectKey, req.ContentType, app.presignTTL)
+	if err != nil {
+		http.Error(w, "Failed to presign upload", http.StatusInternalServerError)
+		fmt.Println("Presign Put Error:", err)
+		return
+	}
+
+	response := PresignUploadResponse{
+		UploadURL:   uploadURL,
+		ObjectKey:   objectKey,
+		ContentType: req.ContentType,
+		ExpiresIn:   int(app.presignTTL.Seconds()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type FinalizeUploadRequest struct {
+	ObjectKey   string `json:"object_key"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+}
+
+// HANDLER: Record the DB row for an object the client uploaded directly to
+// S3 via a presigned URL, once we've confirmed it's actually there.
+func (app *App) finalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req FinalizeUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ObjectKey == "" || req.Filename == "" {
+		http.Error(w, "object_key and filename are required", http.StatusBadRequest)
+		return
+	}
+
+	info, err := app.storage.Head(context.TODO(), req.ObjectKey)
+	if err != nil {
+		http.Error(w, "Object not found in storage", http.StatusBadRequest)
+		return
+	}
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	size := info.Size
+
+	// Upsert the objects row in the same transaction as the images insert,
+	// exactly like createImage, so this object is ref-counted and deleteImage
+	// can find it later - without it, DELETE /images/{id} would match zero
+	// objects rows and 500.
+	tx, err := app.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = observeDBQuery("upsert_object_refcount", func() error {
+		_, qErr := tx.Exec(
+			`INSERT INTO objects (object_key, size, content_type, ref_count)
+			 VALUES ($1, $2, $3, 1)
+			 ON CONFLICT (object_key) DO UPDATE SET ref_count = objects.ref_count + 1`,
+			req.ObjectKey, size, contentType)
+		return qErr
 	})
 	if err != nil {
-		http.Error(w, "Failed to download from S3", http.StatusInternalServerError)
+		http.Error(w, "Database upsert failed", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-	ct := "application/octet-stream"
-	if resp.ContentType != nil && *resp.ContentType != "" {
-		ct = *resp.ContentType
+
+	var id int
+	createdAt := time.Now()
+	err = observeDBQuery("insert_image", func() error {
+		return tx.QueryRow(`INSERT INTO images (filename, size, object_key, content_type, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+			req.Filename, size, req.ObjectKey, contentType, createdAt).Scan(&id)
+	})
+	if err != nil {
+		http.Error(w, "Database insert failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
-	w.Header().Set("Content-Type", ct)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", objectKey))
-	io.Copy(w, resp.Body)
+
+	response := ImageMetadata{
+		ID:          id,
+		Filename:    req.Filename,
+		Size:        size,
+		ObjectKey:   req.ObjectKey,
+		ContentType: contentType,
+		CreatedAt:   createdAt,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type PresignDownloadResponse struct {
+	DownloadURL string `json:"download_url"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// HANDLER: Issue a presigned GET URL so the client can download straight
+// from S3 without streaming the bytes through this server.
+func (app *App) presignDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/presign-download")
+	if id == "" {
+		http.Error(w, "Image ID is required", http.StatusBadRequest)
+		return
+	}
+	imageID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "Invalid Image ID", http.StatusBadRequest)
+		return
+	}
+
+	var objectKey string
+	err = observeDBQuery("select_image_object_key", func() error {
+		return app.db.QueryRow("SELECT object_key FROM images WHERE id=$1", imageID).Scan(&objectKey)
+	})
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	downloadURL, err := app.storage.PresignGet(context.TODO(), objectKey, app.presignTTL)
+	if err != nil {
+		http.Error(w, "Failed to presign download", http.StatusInternalServerError)
+		fmt.Println("Presign Get Error:", err)
+		return
+	}
+
+	response := PresignDownloadResponse{
+		DownloadURL: downloadURL,
+		ExpiresIn:   int(app.presignTTL.Seconds()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
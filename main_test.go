@@ -6,6 +6,14 @@ import (
 	"testing"
 )
 
+func TestContentAddressedKey(t *testing.T) {
+	digest := "abcd1234567890abcd1234567890abcd1234567890abcd1234567890abcd12"
+	want := "sha256/ab/cd/abcd1234567890abcd1234567890abcd1234567890abcd1234567890abcd12"
+	if got := contentAddressedKey(digest); got != want {
+		t.Errorf("contentAddressedKey(%q) = %q, want %q", digest, got, want)
+	}
+}
+
 func TestHealthHandler(t *testing.T) {
 	w := httptest.NewRecorder()
 
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// httpRequestsTotal counts every HTTP response the server has sent, labeled
+// by route and status so dashboards can slice error rates per endpoint.
+var httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "imagestore_http_requests_total",
+	Help: "Total HTTP requests handled, labeled by route and status code.",
+}, []string{"route", "method", "status"})
+
+// httpRequestDuration tracks end-to-end handler latency per route.
+var httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "imagestore_http_request_duration_seconds",
+	Help:    "HTTP request duration in seconds, labeled by route and status code.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"route", "method", "status"})
+
+// s3OperationDuration tracks S3 call latency (including SDK retries, since
+// it's recorded by a smithy middleware wrapping the whole operation) labeled
+// by operation name.
+var s3OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "imagestore_s3_operation_duration_seconds",
+	Help:    "S3 operation duration in seconds, labeled by operation (put, get, delete, head).",
+	Buckets: prometheus.DefBuckets,
+}, []string{"operation"})
+
+// dbQueryDuration tracks how long individual database calls take, labeled by
+// the logical query name (e.g. "insert_image", "select_object_refcount").
+var dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "imagestore_db_query_duration_seconds",
+	Help:    "Database query duration in seconds, labeled by query name.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"query"})
+
+// inFlightUploads and inFlightUploadBytes report the current number and
+// total size of uploads the server is actively streaming to storage.
+var inFlightUploads = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "imagestore_in_flight_uploads",
+	Help: "Number of image uploads currently being streamed to storage.",
+})
+
+var inFlightUploadBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "imagestore_in_flight_upload_bytes",
+	Help: "Total bytes of image uploads currently being streamed to storage.",
+})
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		s3OperationDuration,
+		dbQueryDuration,
+		inFlightUploads,
+		inFlightUploadBytes,
+	)
+}
+
+// observeDBQuery times a database call and records it under queryName. Call
+// sites wrap a single db.Exec/QueryRow invocation with it.
+func observeDBQuery(queryName string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	dbQueryDuration.WithLabelValues(queryName).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// s3MetricsMiddleware is a smithy-go finalize middleware that times each S3
+// operation - including any retries the SDK performs underneath it - and
+// records it against s3OperationDuration under a short operation label.
+type s3MetricsMiddleware struct{}
+
+func (s3MetricsMiddleware) ID() string {
+	return "MetricsTiming"
+}
+
+func (s3MetricsMiddleware) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	start := time.Now()
+	out, metadata, err := next.HandleFinalize(ctx, in)
+	s3OperationDuration.WithLabelValues(s3OperationLabel(middleware.GetOperationName(ctx))).Observe(time.Since(start).Seconds())
+	return out, metadata, err
+}
+
+// s3OperationLabel maps an S3 SDK operation name to the short verb used in
+// metric labels, so PutObject/UploadPart/CreateMultipartUpload etc. all
+// roll up under "put".
+func s3OperationLabel(operation string) string {
+	switch operation {
+	case "PutObject", "UploadPart", "CreateMultipartUpload", "CompleteMultipartUpload", "AbortMultipartUpload", "CopyObject":
+		return "put"
+	case "GetObject":
+		return "get"
+	case "DeleteObject":
+		return "delete"
+	case "HeadObject":
+		return "head"
+	default:
+		return "other"
+	}
+}
+
+// inFlightReader wraps an io.Reader, keeping inFlightUploadBytes in sync as
+// bytes flow through and releasing its share of inFlightUploads/bytes once
+// the stream is fully drained or closed.
+type inFlightReader struct {
+	r    io.Reader
+	read int64
+	done bool
+}
+
+func newInFlightReader(r io.Reader) *inFlightReader {
+	inFlightUploads.Inc()
+	return &inFlightReader{r: r}
+}
+
+func (f *inFlightReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 {
+		f.read += int64(n)
+		inFlightUploadBytes.Add(float64(n))
+	}
+	if err != nil {
+		f.release()
+	}
+	return n, err
+}
+
+// release drops this upload's counts, safe to call more than once.
+func (f *inFlightReader) release() {
+	if f.done {
+		return
+	}
+	f.done = true
+	inFlightUploads.Dec()
+	inFlightUploadBytes.Sub(float64(f.read))
+}
+
+// withS3Metrics is an s3.Options functional option that registers
+// s3MetricsMiddleware on the client, so every request - including retries -
+// is timed. Pass it alongside the other s3.NewFromConfig options.
+func withS3Metrics(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(s3MetricsMiddleware{}, middleware.After)
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// derivativeSizes are the long-edge pixel targets generated for every
+// uploaded image, configurable via DERIVATIVE_SIZES (comma-separated pixel
+// values, e.g. "256,768"). Each produces a "thumb_<size>" variant.
+//
+// Known limitation: every derivative is re-encoded as JPEG regardless of the
+// source format. There's no pure-Go WebP/AVIF *encoder* (only decoders, via
+// the golang.org/x/image/webp import below), so "<key>/thumb_N.webp" output
+// isn't available yet - this is a materially smaller feature than the
+// WebP/AVIF re-encoding originally requested, not just an implementation
+// detail, pending a CGo or external encoder dependency.
+var derivativeSizes = parseDerivativeSizes(os.Getenv("DERIVATIVE_SIZES"))
+
+// parseDerivativeSizes parses a comma-separated DERIVATIVE_SIZES value,
+// falling back to the default {128, 512, 1024} set when unset or unparsable.
+func parseDerivativeSizes(raw string) []int {
+	var sizes []int
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		size, err := strconv.Atoi(part)
+		if err != nil || size <= 0 {
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) == 0 {
+		return []int{128, 512, 1024}
+	}
+	return sizes
+}
+
+// processingWorkers bounds how many derivatives are generated concurrently,
+// so a burst of uploads can't spawn unbounded goroutines.
+const processingWorkers = 4
+
+// processingQueueSize is how many pending jobs can sit in the channel before
+// enqueueProcessing starts blocking the caller.
+const processingQueueSize = 256
+
+type processingJob struct {
+	ImageID     int
+	ObjectKey   string
+	ContentType string
+}
+
+// startProcessingWorkers launches the bounded worker pool that turns
+// processingJobs into derivatives in the background, so createImage can
+// respond as soon as the original upload completes.
+func (app *App) startProcessingWorkers() {
+	app.processingQueue = make(chan processingJob, processingQueueSize)
+	for i := 0; i < processingWorkers; i++ {
+		go func() {
+			for job := range app.processingQueue {
+				for _, size := range derivativeSizes {
+					name := fmt.Sprintf("thumb_%d", size)
+					if _, _, err := app.getOrGenerateDerivative(context.Background(), job.ImageID, job.ObjectKey, name); err != nil {
+						fmt.Printf("Derivative %s for image %d failed: %v\n", name, job.ImageID, err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// enqueueProcessing schedules derivative generation for a freshly uploaded
+// image. It never blocks the HTTP response for more than a full queue.
+func (app *App) enqueueProcessing(imageID int, objectKey, contentType string) {
+	app.processingQueue <- processingJob{ImageID: imageID, ObjectKey: objectKey, ContentType: contentType}
+}
+
+// getOrGenerateDerivative returns the object key and content type for the
+// named derivative (e.g. "thumb_512"), generating it on demand if it
+// doesn't exist in the derivatives table yet.
+func (app *App) getOrGenerateDerivative(ctx context.Context, imageID int, sourceObjectKey, name string) (string, string, error) {
+	var objectKey, contentType string
+	err := observeDBQuery("select_derivative", func() error {
+		return app.db.QueryRow("SELECT object_key, content_type FROM derivatives WHERE image_id=$1 AND name=$2", imageID, name).
+			Scan(&objectKey, &contentType)
+	})
+	if err == nil {
+		return objectKey, contentType, nil
+	}
+
+	size, err := parseThumbSize(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	body, _, err := app.storage.Get(ctx, sourceObjectKey)
+	if err != nil {
+		return "", "", fmt.Errorf("fetch source object: %w", err)
+	}
+	defer body.Close()
+
+	// Decoding and re-encoding drops any EXIF block the original carried -
+	// neither image/jpeg nor image/png writes one back out.
+	src, _, err := image.Decode(body)
+	if err != nil {
+		return "", "", fmt.Errorf("decode image: %w", err)
+	}
+
+	resized := resizeToLongEdge(src, size)
+
+	derivativeKey := sourceObjectKey + "/" + name + ".jpg"
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(jpeg.Encode(pw, resized, &jpeg.Options{Quality: 85}))
+	}()
+	if err := app.storage.Put(ctx, derivativeKey, pr, "image/jpeg"); err != nil {
+		// Unblock the encoder goroutine's pending pw.Write - otherwise it
+		// leaks forever since nothing else ever reads from pr.
+		pr.CloseWithError(err)
+		return "", "", fmt.Errorf("store derivative: %w", err)
+	}
+
+	err = observeDBQuery("insert_derivative", func() error {
+		_, qErr := app.db.Exec(`INSERT INTO derivatives (image_id, name, object_key, content_type, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (image_id, name) DO UPDATE SET object_key = EXCLUDED.object_key, content_type = EXCLUDED.content_type`,
+			imageID, name, derivativeKey, "image/jpeg", time.Now())
+		return qErr
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("record derivative: %w", err)
+	}
+
+	return derivativeKey, "image/jpeg", nil
+}
+
+// parseThumbSize extracts the pixel size from a derivative name like "thumb_512".
+func parseThumbSize(name string) (int, error) {
+	raw := strings.TrimPrefix(name, "thumb_")
+	if raw == name {
+		return 0, fmt.Errorf("unknown derivative %q", name)
+	}
+	size, err := strconv.Atoi(raw)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("unknown derivative %q", name)
+	}
+	return size, nil
+}
+
+// resizeToLongEdge scales src so its longest side is exactly longEdge
+// pixels, preserving aspect ratio. Images already smaller than longEdge are
+// left at their original size.
+func resizeToLongEdge(src image.Image, longEdge int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= 0 || h <= 0 {
+		return src
+	}
+
+	scale := float64(longEdge) / float64(max(w, h))
+	if scale >= 1 {
+		return src
+	}
+
+	dstW := int(float64(w) * scale)
+	dstH := int(float64(h) * scale)
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
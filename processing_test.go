@@ -0,0 +1,82 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestResizeToLongEdge(t *testing.T) {
+	tests := []struct {
+		name           string
+		w, h, longEdge int
+		wantW, wantH   int
+	}{
+		{"scales down landscape", 1000, 500, 100, 100, 50},
+		{"scales down portrait", 500, 1000, 100, 50, 100},
+		{"leaves smaller image untouched", 50, 50, 100, 50, 50},
+		{"leaves exact match untouched", 100, 100, 100, 100, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewRGBA(image.Rect(0, 0, tt.w, tt.h))
+			dst := resizeToLongEdge(src, tt.longEdge)
+			b := dst.Bounds()
+			if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("resizeToLongEdge(%dx%d, %d) = %dx%d, want %dx%d",
+					tt.w, tt.h, tt.longEdge, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestParseThumbSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{"valid size", "thumb_512", 512, false},
+		{"missing prefix", "512", 0, true},
+		{"non-numeric", "thumb_big", 0, true},
+		{"zero size", "thumb_0", 0, true},
+		{"negative size", "thumb_-5", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseThumbSize(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseThumbSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseThumbSize(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDerivativeSizes(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []int
+	}{
+		{"unset falls back to default", "", []int{128, 512, 1024}},
+		{"custom sizes", "256,768", []int{256, 768}},
+		{"whitespace tolerated", " 256 , 768 ", []int{256, 768}},
+		{"invalid entries skipped", "256,bogus,-5,768", []int{256, 768}},
+		{"all invalid falls back to default", "bogus,-5", []int{128, 512, 1024}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDerivativeSizes(tt.input)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDerivativeSizes(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
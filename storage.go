@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/gcsblob"
+	"gocloud.dev/blob/s3blob"
+)
+
+// ObjectInfo describes what a storage backend knows about a stored object
+// without having to stream its body.
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+}
+
+// GetRangeOptions carries the client-supplied conditional/range headers
+// through to the storage backend, so it can do the minimum necessary work
+// (skip the transfer on a cache hit, only send the requested byte range).
+type GetRangeOptions struct {
+	Range           string // raw HTTP Range header, e.g. "bytes=0-1023"
+	IfNoneMatch     string
+	IfModifiedSince time.Time // zero value means "not set"
+}
+
+// GetRangeResult is what a backend knows after honoring GetRangeOptions.
+// When NotModified is true, Body is nil and the caller should respond 304.
+type GetRangeResult struct {
+	Body          io.ReadCloser
+	ContentType   string
+	ContentLength int64
+	ContentRange  string // set only when the response is a partial range
+	ETag          string
+	LastModified  time.Time
+	NotModified   bool
+}
+
+// Storage abstracts the object store so App doesn't hard-code the AWS SDK.
+// Implementations: s3Storage (native AWS SDK v2), fsStorage (local disk,
+// used for dev/testing), and gocloudStorage (gocloud.dev/blob, for GCS,
+// Azure Blob, or anything else blob.OpenBucket understands).
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	// GetRange is like Get but honors a byte range and conditional headers,
+	// for /download/ to support resumable downloads and HTTP caching.
+	GetRange(ctx context.Context, key string, opts GetRangeOptions) (GetRangeResult, error)
+	Delete(ctx context.Context, key string) error
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	// Copy duplicates an object server-side, without round-tripping the
+	// bytes through this process where the backend can avoid it.
+	Copy(ctx context.Context, srcKey, dstKey string) error
+	PresignPut(ctx context.Context, key, contentType string, ttl time.Duration) (string, error)
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// errPresignUnsupported is returned by backends that have no notion of a
+// presigned URL (e.g. plain local disk).
+var errPresignUnsupported = fmt.Errorf("presigned URLs are not supported by this storage backend")
+
+// errRangeNotSatisfiable signals that a client's Range header doesn't fit
+// the object's actual size (or isn't parsable), so the caller can respond
+// 416 with a Content-Range: bytes */<size> instead of a 500.
+type errRangeNotSatisfiable struct {
+	size int64
+}
+
+func (e *errRangeNotSatisfiable) Error() string {
+	return fmt.Sprintf("range not satisfiable against object of size %d", e.size)
+}
+
+// ---- s3Storage: the original AWS SDK v2 driver ----
+
+type s3Storage struct {
+	client        *s3.Client
+	presignClient *s3.PresignClient
+	bucket        string
+}
+
+func newS3Storage(client *s3.Client, presignClient *s3.PresignClient, bucket string) *s3Storage {
+	return &s3Storage{client: client, presignClient: presignClient, bucket: bucket}
+}
+
+// Put streams r into S3 via the multipart upload API so large uploads never
+// have to be buffered in memory.
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	abort := func() {
+		_, _ = s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+	}
+
+	var completedParts []types.CompletedPart
+	partNumber := int32(1)
+	buf := make([]byte, uploadPartSize)
+
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			uploaded, uploadErr := s.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(s.bucket),
+				Key:        aws.String(key),
+				UploadId:   uploadID,
+				PartNumber: aws.Int32(partNumber),
+				Body:       bytes.NewReader(buf[:n]),
+			})
+			if uploadErr != nil {
+				abort()
+				return fmt.Errorf("upload part %d: %w", partNumber, uploadErr)
+			}
+			completedParts = append(completedParts, types.CompletedPart{
+				ETag:       uploaded.ETag,
+				PartNumber: aws.Int32(partNumber),
+			})
+			partNumber++
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			abort()
+			return fmt.Errorf("read upload stream: %w", readErr)
+		}
+	}
+
+	if len(completedParts) == 0 {
+		abort()
+		return fmt.Errorf("upload stream was empty")
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if err != nil {
+		abort()
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := "application/octet-stream"
+	if resp.ContentType != nil && *resp.ContentType != "" {
+		contentType = *resp.ContentType
+	}
+	return resp.Body, contentType, nil
+}
+
+func (s *s3Storage) GetRange(ctx context.Context, key string, opts GetRangeOptions) (GetRangeResult, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if opts.Range != "" {
+		input.Range = aws.String(opts.Range)
+	}
+	if opts.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(opts.IfNoneMatch)
+	}
+	if !opts.IfModifiedSince.IsZero() {
+		input.IfModifiedSince = aws.Time(opts.IfModifiedSince)
+	}
+
+	resp, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) {
+			switch respErr.HTTPStatusCode() {
+			case http.StatusNotModified:
+				return GetRangeResult{NotModified: true}, nil
+			case http.StatusRequestedRangeNotSatisfiable:
+				info, headErr := s.Head(ctx, key)
+				if headErr != nil {
+					return GetRangeResult{}, err
+				}
+				return GetRangeResult{}, &errRangeNotSatisfiable{size: info.Size}
+			}
+		}
+		return GetRangeResult{}, err
+	}
+
+	result := GetRangeResult{
+		Body:        resp.Body,
+		ContentType: "application/octet-stream",
+	}
+	if resp.ContentType != nil && *resp.ContentType != "" {
+		result.ContentType = *resp.ContentType
+	}
+	if resp.ContentLength != nil {
+		result.ContentLength = *resp.ContentLength
+	}
+	if resp.ContentRange != nil {
+		result.ContentRange = *resp.ContentRange
+	}
+	if resp.ETag != nil {
+		result.ETag = *resp.ETag
+	}
+	if resp.LastModified != nil {
+		result.LastModified = *resp.LastModified
+	}
+	return result, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info := ObjectInfo{}
+	if resp.ContentLength != nil {
+		info.Size = *resp.ContentLength
+	}
+	if resp.ContentType != nil {
+		info.ContentType = *resp.ContentType
+	}
+	return info, nil
+}
+
+func (s *s3Storage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(s.bucket + "/" + srcKey),
+	})
+	return err
+}
+
+func (s *s3Storage) PresignPut(ctx context.Context, key, contentType string, ttl time.Duration) (string, error) {
+	presigned, err := s.presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return presigned.URL, nil
+}
+
+func (s *s3Storage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigned, err := s.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return presigned.URL, nil
+}
+
+// ---- fsStorage: local filesystem driver for dev/testing ----
+
+type fsStorage struct {
+	baseDir string
+}
+
+func newFSStorage(baseDir string) (*fsStorage, error) {
+	if err := os.MkdirAll(baseDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage dir: %w", err)
+	}
+	return &fsStorage{baseDir: baseDir}, nil
+}
+
+func (f *fsStorage) path(key string) string {
+	return filepath.Join(f.baseDir, filepath.FromSlash(key))
+}
+
+func (f *fsStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	path := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	// content type isn't a first-class concept on disk; stash it alongside
+	// the object so Get/Head can report something sensible.
+	return os.WriteFile(path+".contenttype", []byte(contentType), 0o644)
+}
+
+func (f *fsStorage) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	file, err := os.Open(f.path(key))
+	if err != nil {
+		return nil, "", err
+	}
+	return file, f.readContentType(key), nil
+}
+
+func (f *fsStorage) Delete(ctx context.Context, key string) error {
+	_ = os.Remove(f.path(key) + ".contenttype")
+	return os.Remove(f.path(key))
+}
+
+func (f *fsStorage) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	stat, err := os.Stat(f.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: stat.Size(), ContentType: f.readContentType(key)}, nil
+}
+
+func (f *fsStorage) readContentType(key string) string {
+	data, err := os.ReadFile(f.path(key) + ".contenttype")
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return string(data)
+}
+
+// limitedReadCloser pairs a size-limited Reader with the Closer of the
+// underlying file, so callers still release the file handle correctly.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (f *fsStorage) GetRange(ctx context.Context, key string, opts GetRangeOptions) (GetRangeResult, error) {
+	stat, err := os.Stat(f.path(key))
+	if err != nil {
+		return GetRangeResult{}, err
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size())
+	if opts.IfNoneMatch != "" && opts.IfNoneMatch == etag {
+		return GetRangeResult{NotModified: true}, nil
+	}
+	if !opts.IfModifiedSince.IsZero() && !stat.ModTime().Truncate(time.Second).After(opts.IfModifiedSince) {
+		return GetRangeResult{NotModified: true}, nil
+	}
+
+	file, err := os.Open(f.path(key))
+	if err != nil {
+		return GetRangeResult{}, err
+	}
+
+	result := GetRangeResult{
+		ContentType:  f.readContentType(key),
+		ETag:         etag,
+		LastModified: stat.ModTime(),
+	}
+
+	if opts.Range != "" {
+		start, length, ok := parseByteRange(opts.Range, stat.Size())
+		if !ok {
+			file.Close()
+			return GetRangeResult{}, &errRangeNotSatisfiable{size: stat.Size()}
+		}
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			file.Close()
+			return GetRangeResult{}, err
+		}
+		result.Body = limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}
+		result.ContentLength = length
+		result.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, stat.Size())
+		return result, nil
+	}
+
+	result.Body = file
+	result.ContentLength = stat.Size()
+	return result, nil
+}
+
+// parseByteRange parses a single-range HTTP Range header value (e.g.
+// "bytes=0-1023", "bytes=1024-", "bytes=-512") against a known object size.
+func parseByteRange(header string, size int64) (start, length int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, false
+	}
+	spec := strings.SplitN(strings.TrimPrefix(header, prefix), ",", 2)[0]
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	if parts[0] == "" {
+		// Suffix range: last N bytes.
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+func (f *fsStorage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	src, contentType, err := f.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return f.Put(ctx, dstKey, src, contentType)
+}
+
+func (f *fsStorage) PresignPut(ctx context.Context, key, contentType string, ttl time.Duration) (string, error) {
+	return "", errPresignUnsupported
+}
+
+func (f *fsStorage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", errPresignUnsupported
+}
+
+// ---- gocloudStorage: gocloud.dev/blob driver (GCS, Azure Blob, etc.) ----
+
+type gocloudStorage struct {
+	bucket *blob.Bucket
+}
+
+// openGoCloudStorage opens a gocloud.dev/blob bucket from a URL such as
+// "gs://my-bucket" or "azblob://my-container". s3:// URLs are handled by
+// s3blob's URLOpener, registered via the blank import below.
+func openGoCloudStorage(ctx context.Context, storageURL string) (*gocloudStorage, error) {
+	bucket, err := blob.OpenBucket(ctx, storageURL)
+	if err != nil {
+		return nil, fmt.Errorf("open bucket %q: %w", storageURL, err)
+	}
+	return &gocloudStorage{bucket: bucket}, nil
+}
+
+func (g *gocloudStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	writer, err := g.bucket.NewWriter(ctx, key, &blob.WriterOptions{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, r); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (g *gocloudStorage) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	reader, err := g.bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return reader, reader.ContentType(), nil
+}
+
+func (g *gocloudStorage) GetRange(ctx context.Context, key string, opts GetRangeOptions) (GetRangeResult, error) {
+	attrs, err := g.bucket.Attributes(ctx, key)
+	if err != nil {
+		return GetRangeResult{}, err
+	}
+	etag := attrs.ETag
+	if opts.IfNoneMatch != "" && opts.IfNoneMatch == etag {
+		return GetRangeResult{NotModified: true}, nil
+	}
+	if !opts.IfModifiedSince.IsZero() && !attrs.ModTime.Truncate(time.Second).After(opts.IfModifiedSince) {
+		return GetRangeResult{NotModified: true}, nil
+	}
+
+	result := GetRangeResult{
+		ContentType:  attrs.ContentType,
+		ETag:         etag,
+		LastModified: attrs.ModTime,
+	}
+
+	var offset, length int64 = 0, -1
+	if opts.Range != "" {
+		start, rangeLen, ok := parseByteRange(opts.Range, attrs.Size)
+		if !ok {
+			return GetRangeResult{}, &errRangeNotSatisfiable{size: attrs.Size}
+		}
+		offset, length = start, rangeLen
+		result.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, start+rangeLen-1, attrs.Size)
+	}
+
+	reader, err := g.bucket.NewRangeReader(ctx, key, offset, length, nil)
+	if err != nil {
+		return GetRangeResult{}, err
+	}
+	result.Body = reader
+	if length >= 0 {
+		result.ContentLength = length
+	} else {
+		result.ContentLength = reader.Size()
+	}
+	return result, nil
+}
+
+func (g *gocloudStorage) Delete(ctx context.Context, key string) error {
+	return g.bucket.Delete(ctx, key)
+}
+
+func (g *gocloudStorage) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	attrs, err := g.bucket.Attributes(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: attrs.Size, ContentType: attrs.ContentType}, nil
+}
+
+func (g *gocloudStorage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return g.bucket.Copy(ctx, dstKey, srcKey, nil)
+}
+
+func (g *gocloudStorage) PresignPut(ctx context.Context, key, contentType string, ttl time.Duration) (string, error) {
+	return g.bucket.SignedURL(ctx, key, &blob.SignedURLOptions{Method: "PUT", Expiry: ttl, ContentType: contentType})
+}
+
+func (g *gocloudStorage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return g.bucket.SignedURL(ctx, key, &blob.SignedURLOptions{Method: "GET", Expiry: ttl})
+}
+
+// importing s3blob registers the "s3" scheme with blob.OpenBucket, in case
+// STORAGE_URL points at an S3-compatible endpoint instead of going through
+// the native s3Storage driver above.
+var _ = s3blob.Scheme
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestParseByteRange(t *testing.T) {
+	const size = int64(1000)
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStart  int64
+		wantLength int64
+		wantOK     bool
+	}{
+		{"simple range", "bytes=0-499", 0, 500, true},
+		{"mid range", "bytes=500-999", 500, 500, true},
+		{"open-ended range", "bytes=900-", 900, 100, true},
+		{"suffix range", "bytes=-100", 900, 100, true},
+		{"suffix range larger than size", "bytes=-5000", 0, 1000, true},
+		{"end clamped to size", "bytes=0-999999", 0, 1000, true},
+		{"missing prefix", "0-499", 0, 0, false},
+		{"start at size is out of bounds", "bytes=1000-", 0, 0, false},
+		{"start beyond size", "bytes=99999999-", 0, 0, false},
+		{"end before start", "bytes=500-100", 0, 0, false},
+		{"non-numeric start", "bytes=abc-499", 0, 0, false},
+		{"empty spec", "bytes=", 0, 0, false},
+		{"zero-length suffix", "bytes=-0", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, length, ok := parseByteRange(tt.header, size)
+			if ok != tt.wantOK {
+				t.Fatalf("parseByteRange(%q, %d) ok = %v, want %v", tt.header, size, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if start != tt.wantStart || length != tt.wantLength {
+				t.Errorf("parseByteRange(%q, %d) = (%d, %d), want (%d, %d)",
+					tt.header, size, start, length, tt.wantStart, tt.wantLength)
+			}
+		})
+	}
+}